@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -8,23 +11,223 @@ import (
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
-	addr           = flag.String("web.listen-address", ":8080", "The address to listen on for HTTP requests.")
-	metricsPath    = flag.String("web.telemetry-path", "/metrics", "The address to listen on for HTTP requests.")
-	kibanaUri      = flag.String("kibana.uri", "", "The Kibana API to fetch metrics from")
-	kibanaUsername = flag.String("kibana.username", "", "The username to use for Kibana API")
-	kibanaPassword = flag.String("kibana.password", "", "The password to use for Kibana API")
-	namespace      = "kibana"
+	addr                  = flag.String("web.listen-address", ":8080", "The address to listen on for HTTP requests.")
+	metricsPath           = flag.String("web.telemetry-path", "/metrics", "The address to listen on for HTTP requests.")
+	probePath             = flag.String("web.probe-path", "/probe", "The path to respond to multi-target probe requests on.")
+	kibanaUri             = flag.String("kibana.uri", "", "The Kibana API to fetch metrics from")
+	kibanaUsername        = flag.String("kibana.username", "", "The username to use for Kibana API")
+	kibanaPassword        = flag.String("kibana.password", "", "The password to use for Kibana API")
+	kibanaBearerToken     = flag.String("kibana.bearer-token", "", "The bearer token to use for Kibana API")
+	kibanaBearerTokenFile = flag.String("kibana.bearer-token-file", "", "Path to a file containing a bearer token to use for Kibana API, re-read on every scrape")
+	kibanaApiKey          = flag.String("kibana.api-key", "", "The Elasticsearch API key to use for Kibana API")
+	kibanaCaFile          = flag.String("kibana.ca-file", "", "Path to a PEM encoded CA certificate to use when verifying the Kibana API")
+	kibanaCertFile        = flag.String("kibana.cert-file", "", "Path to a PEM encoded client certificate to use for mTLS with the Kibana API")
+	kibanaKeyFile         = flag.String("kibana.key-file", "", "Path to a PEM encoded client key to use for mTLS with the Kibana API")
+	kibanaInsecureSkip    = flag.Bool("kibana.insecure-skip-verify", false, "Disable TLS certificate verification for the Kibana API")
+	kibanaTimeout         = flag.Duration("kibana.timeout", 10*time.Second, "Timeout for requests against the Kibana API")
+	configFile            = flag.String("config.file", "", "Path to a YAML file describing the modules available to /probe")
+	webConfigFile         = flag.String("web.config.file", "", "Path to a YAML file with TLS and basic auth settings for the web server, in the style of exporter-toolkit's web-config")
+	namespace             = "kibana"
 )
 
+// TLSServerConfig describes the certificate, key, and optional client
+// CA to serve TLS with, mirroring exporter-toolkit's web-config.yml
+// tls_server_config block.
+type TLSServerConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// WebConfig is the top level structure of -web.config.file.
+// BasicAuthUsers maps a username to a bcrypt password hash; when
+// non-empty, requests to -web.telemetry-path and -web.probe-path must
+// authenticate as one of these users.
+type WebConfig struct {
+	TLSConfig      TLSServerConfig   `yaml:"tls_server_config"`
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+}
+
+// loadWebConfig reads and parses the YAML file pointed to by
+// -web.config.file.
+func loadWebConfig(path string) (*WebConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read web config file: %s", err)
+	}
+
+	cfg := &WebConfig{}
+	if err := yaml.Unmarshal(content, cfg); err != nil {
+		return nil, fmt.Errorf("could not parse web config file: %s", err)
+	}
+
+	return cfg, nil
+}
+
+// buildServerTLSConfig builds the server-side *tls.Config for
+// cfg, requiring and verifying client certificates against
+// ClientCAFile when it is set, enabling mTLS for every path the web
+// server serves.
+func buildServerTLSConfig(cfg TLSServerConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if cfg.ClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	caCert, err := ioutil.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read client CA file: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("could not parse client CA file %s", cfg.ClientCAFile)
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return tlsConfig, nil
+}
+
+// dummyBasicAuthHash is compared against for unknown usernames so that
+// basicAuthMiddleware takes the same amount of time whether or not the
+// username exists, preventing it from being used as a timing oracle
+// for username enumeration.
+const dummyBasicAuthHash = "$2a$10$mmqc3mtwN5mK9/KN9cCWluYTWE5Eg091NqbBhcw/.auaGmtWrHEvC"
+
+// basicAuthMiddleware wraps next so that requests must authenticate
+// as one of users (username -> bcrypt password hash) via HTTP Basic
+// auth.
+func basicAuthMiddleware(next http.Handler, users map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		hash, known := users[username]
+		if !known {
+			hash = dummyBasicAuthHash
+		}
+		// Always run the bcrypt comparison, even for an unknown
+		// username, so the response time doesn't leak which
+		// usernames are valid.
+		match := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+		if !ok || !known || !match {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kibana-prometheus-exporter"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AuthConfig bundles the authentication and TLS settings used to
+// build a KibanaCollector, whether sourced from the static
+// -kibana.* flags or a /probe module loaded from -config.file.
+// BearerToken takes precedence over BearerTokenFile, which takes
+// precedence over APIKey, which takes precedence over
+// Username/Password.
+type AuthConfig struct {
+	Username           string
+	Password           string
+	BearerToken        string
+	BearerTokenFile    string
+	APIKey             string
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+	Timeout            time.Duration
+}
+
+// ModuleConfig describes how to authenticate against the Kibana
+// instances that share a given -config.file module, e.g. the
+// credentials used for a fleet of Kibanas behind the same reverse
+// proxy.
+type ModuleConfig struct {
+	Username           string        `yaml:"username"`
+	Password           string        `yaml:"password"`
+	BearerToken        string        `yaml:"bearer_token"`
+	BearerTokenFile    string        `yaml:"bearer_token_file"`
+	APIKey             string        `yaml:"api_key"`
+	CAFile             string        `yaml:"ca_file"`
+	CertFile           string        `yaml:"cert_file"`
+	KeyFile            string        `yaml:"key_file"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+	Timeout            time.Duration `yaml:"timeout"`
+}
+
+// AuthConfig converts a ModuleConfig loaded from -config.file into
+// the AuthConfig used to build a KibanaCollector, falling back to
+// -kibana.timeout when the module does not set its own.
+func (m ModuleConfig) AuthConfig() AuthConfig {
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = *kibanaTimeout
+	}
+
+	return AuthConfig{
+		Username:           m.Username,
+		Password:           m.Password,
+		BearerToken:        m.BearerToken,
+		BearerTokenFile:    m.BearerTokenFile,
+		APIKey:             m.APIKey,
+		CAFile:             m.CAFile,
+		CertFile:           m.CertFile,
+		KeyFile:            m.KeyFile,
+		InsecureSkipVerify: m.InsecureSkipVerify,
+		Timeout:            timeout,
+	}
+}
+
+// TargetConfig carries target-specific metadata that cannot be
+// inferred from the target URL alone, such as the logical cluster
+// name to attach as a label.
+type TargetConfig struct {
+	Cluster string `yaml:"cluster"`
+}
+
+// ProbeConfig is the top level structure of -config.file. Modules
+// group together auth/TLS settings that can be reused across many
+// targets, while targets map individual Kibana URLs to extra
+// metadata such as their cluster label.
+type ProbeConfig struct {
+	Modules map[string]ModuleConfig `yaml:"modules"`
+	Targets map[string]TargetConfig `yaml:"targets"`
+}
+
+// loadProbeConfig reads and parses the YAML file pointed to by
+// -config.file. It is re-read on every /probe request so that
+// credential changes do not require a restart.
+func loadProbeConfig(path string) (*ProbeConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %s", err)
+	}
+
+	cfg := &ProbeConfig{}
+	if err := yaml.Unmarshal(content, cfg); err != nil {
+		return nil, fmt.Errorf("could not parse config file: %s", err)
+	}
+
+	return cfg, nil
+}
+
 // A type that collects the Kibana information together to be used by
 // the exporter to scrape metrics.
 type KibanaCollector struct {
@@ -33,45 +236,278 @@ type KibanaCollector struct {
 
 	// authHeader is the string that should be used as the value
 	// for the "Authorization" header. If this is empty, it is
-	// assumed that no authorization is needed.
+	// assumed that no authorization is needed. Ignored when
+	// bearerTokenFile is set.
 	authHeader string
 
+	// bearerTokenFile, when set, is read fresh before every scrape
+	// so that projected Kubernetes service account tokens keep
+	// working past rotation.
+	bearerTokenFile string
+
 	// client is the http.Client that will be used to make
 	// requests to collect the Kibana metrics
 	client *http.Client
+
+	// timeout bounds each scrape request via context.WithTimeout
+	timeout time.Duration
+}
+
+// buildTransport builds the *http.Transport used by a KibanaCollector
+// from the given AuthConfig, configuring a custom CA, a client
+// certificate for mTLS, and/or disabling verification as requested.
+func buildTransport(cfg AuthConfig) (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		caCert, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("could not parse CA file %s", cfg.CAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate/key: %s", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+	}, nil
+}
+
+// probeTransportTTL bounds how long a cached probe transport may sit
+// idle before probeTransportJanitor evicts it. Prometheus relabeling
+// across an ephemeral fleet (k8s pods, short-lived Kibana URLs) means
+// the set of targets probed changes over time, so without eviction
+// probeTransports would grow forever and never release its idle
+// connection pools or loaded mTLS client certs.
+const probeTransportTTL = 10 * time.Minute
+
+// probeTransportSweepInterval is how often probeTransportJanitor scans
+// probeTransports for entries older than probeTransportTTL.
+const probeTransportSweepInterval = time.Minute
+
+// cachedTransport pairs a built *http.Transport with the unix-nano
+// timestamp it was last handed out, so probeTransportJanitor can tell
+// idle entries apart from ones still in active use.
+type cachedTransport struct {
+	transport *http.Transport
+	lastUsed  int64 // unix nano, accessed atomically
+}
+
+// probeTransports caches the *http.Transport built for each (target,
+// module) pair probeHandler serves, so that repeated scrapes of the
+// same target reuse TCP/TLS connections instead of paying a fresh
+// handshake, and mTLS configs a fresh client cert load, on every
+// single probe. Entries unused for probeTransportTTL are evicted by
+// probeTransportJanitor.
+var probeTransports sync.Map // map[string]*cachedTransport
+
+func init() {
+	go probeTransportJanitor()
+}
+
+// probeTransportJanitor runs for the life of the process, periodically
+// evicting probeTransports entries that have not been touched in
+// probeTransportTTL.
+func probeTransportJanitor() {
+	ticker := time.NewTicker(probeTransportSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cutoff := time.Now().Add(-probeTransportTTL).UnixNano()
+		probeTransports.Range(func(key, value interface{}) bool {
+			ct := value.(*cachedTransport)
+			if atomic.LoadInt64(&ct.lastUsed) < cutoff {
+				probeTransports.Delete(key)
+			}
+			return true
+		})
+	}
+}
+
+// probeTransportKey builds the cachedProbeTransport cache key for a
+// /probe request, folding in the transport-relevant (TLS) fields of
+// cfg alongside module and target. -config.file is re-read on every
+// probe specifically so edits take effect without a restart; keying
+// on module+target alone would defeat that for a target scraped on a
+// steady interval, since it would never go idle long enough for
+// probeTransportJanitor to evict the stale transport built from its
+// old CA/client cert/insecure-skip-verify settings.
+func probeTransportKey(module, target string, cfg AuthConfig) string {
+	return strings.Join([]string{
+		module,
+		target,
+		cfg.CAFile,
+		cfg.CertFile,
+		cfg.KeyFile,
+		strconv.FormatBool(cfg.InsecureSkipVerify),
+	}, "|")
+}
+
+// cachedProbeTransport returns the *http.Transport for key, building
+// and caching one from cfg the first time key is seen, and refreshing
+// its last-used time so probeTransportJanitor leaves it alone while
+// it's still in use.
+func cachedProbeTransport(key string, cfg AuthConfig) (*http.Transport, error) {
+	now := time.Now().UnixNano()
+
+	if v, ok := probeTransports.Load(key); ok {
+		ct := v.(*cachedTransport)
+		atomic.StoreInt64(&ct.lastUsed, now)
+		return ct.transport, nil
+	}
+
+	transport, err := buildTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ct := &cachedTransport{transport: transport, lastUsed: now}
+	actual, _ := probeTransports.LoadOrStore(key, ct)
+	actualCt := actual.(*cachedTransport)
+	atomic.StoreInt64(&actualCt.lastUsed, now)
+	return actualCt.transport, nil
+}
+
+// newKibanaCollector builds a KibanaCollector for kUrl using the
+// given AuthConfig and transport, picking the strongest auth method
+// that was configured: bearer token (static or file), then API key,
+// then Basic auth.
+func newKibanaCollector(kUrl string, cfg AuthConfig, transport *http.Transport) (*KibanaCollector, error) {
+	collector := &KibanaCollector{
+		url:     kUrl,
+		client:  &http.Client{Transport: transport},
+		timeout: cfg.Timeout,
+	}
+
+	switch {
+	case cfg.BearerToken != "":
+		log.Printf("using bearer token requests with Kibana")
+		collector.authHeader = fmt.Sprintf("Bearer %s", cfg.BearerToken)
+	case cfg.BearerTokenFile != "":
+		log.Printf("using bearer token file requests with Kibana")
+		collector.bearerTokenFile = cfg.BearerTokenFile
+	case cfg.APIKey != "":
+		log.Printf("using API key requests with Kibana")
+		collector.authHeader = fmt.Sprintf("ApiKey %s", cfg.APIKey)
+	case cfg.Username != "" && cfg.Password != "":
+		log.Printf("using authenticated requests with Kibana")
+		creds := fmt.Sprintf("%s:%s", cfg.Username, cfg.Password)
+		encCreds := base64.StdEncoding.EncodeToString([]byte(creds))
+		collector.authHeader = fmt.Sprintf("Basic %s", encCreds)
+	default:
+		log.Print("Kibana username or password is not provided, assuming unauthenticated communication")
+	}
+
+	return collector, nil
 }
 
 // A type that implements the prometheus.Collector interface. This will
-// be used to register the metrics with Prometheus.
+// be used to register the metrics with Prometheus. Describe/Collect
+// build prometheus.MustNewConstMetric values from the cached *Desc
+// handles below on every scrape, rather than holding long-lived
+// Gauge/GaugeVec fields that would need to be mutated under a shared
+// lock and would leak stale values across scrapes that fail partway
+// through.
 type Exporter struct {
-	lock      sync.RWMutex
 	collector *KibanaCollector
 
-	status                prometheus.Gauge
-	concurrentConnections prometheus.Gauge
-	uptime                prometheus.Gauge
-	heapTotal             prometheus.Gauge
-	heapUsed              prometheus.Gauge
-	load1m                prometheus.Gauge
-	load5m                prometheus.Gauge
-	load15m               prometheus.Gauge
-	respTimeAvg           prometheus.Gauge
-	respTimeMax           prometheus.Gauge
-	reqDisconnects        prometheus.Gauge
-	reqTotal              prometheus.Gauge
+	scrapeErrors *prometheus.CounterVec
+
+	upDesc             *prometheus.Desc
+	scrapeDurationDesc *prometheus.Desc
+	versionInfoDesc    *prometheus.Desc
+
+	statusDesc                *prometheus.Desc
+	concurrentConnectionsDesc *prometheus.Desc
+	uptimeDesc                *prometheus.Desc
+	heapTotalDesc             *prometheus.Desc
+	heapUsedDesc              *prometheus.Desc
+	load1mDesc                *prometheus.Desc
+	load5mDesc                *prometheus.Desc
+	load15mDesc               *prometheus.Desc
+	respTimeAvgDesc           *prometheus.Desc
+	respTimeMaxDesc           *prometheus.Desc
+	reqDisconnectsDesc        *prometheus.Desc
+	reqTotalDesc              *prometheus.Desc
+	pluginStatusDesc          *prometheus.Desc
+
+	// Metrics only available on Kibana 8.x, where /api/status grew
+	// an event loop delay gauge, a cgroup-aware memory reading, and
+	// a breakdown of response status codes.
+	cgroupMemoryDesc   *prometheus.Desc
+	eventLoopDelayDesc *prometheus.Desc
+	reqStatusCodesDesc *prometheus.Desc
+}
+
+// kibanaStatusStates enumerates the states a Kibana plugin/core
+// service can report in status.statuses[], used to emit a 1/0 gauge
+// per plugin/state combination.
+var kibanaStatusStates = []string{"green", "yellow", "red"}
+
+// scrapeError wraps an error encountered while scraping a Kibana
+// target with a coarse-grained kind ("request", "http_status", or
+// "decode"), used to label kibana_scrape_errors_total.
+type scrapeError struct {
+	kind string
+	err  error
+}
+
+func (e *scrapeError) Error() string {
+	return e.err.Error()
+}
+
+// errorKind returns the scrapeError kind for err, defaulting to
+// "request" for errors that were not produced by scrape().
+func errorKind(err error) string {
+	if se, ok := err.(*scrapeError); ok {
+		return se.kind
+	}
+	return "request"
+}
+
+// KibanaPluginStatus is one entry of status.statuses[] in the Kibana
+// /api/status?extended response, describing the health of a single
+// plugin or core service (e.g. "plugin:elasticsearch@7.x").
+type KibanaPluginStatus struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
 }
 
 // A type that is used to unmarshal the metrics response from Kibana.
 type KibanaMetrics struct {
+	Version struct {
+		Number string `json:"number"`
+	} `json:"version"`
 	Status struct {
 		Overall struct {
 			State string `json:"state"`
 		} `json:"overall"`
+		Statuses []KibanaPluginStatus `json:"statuses"`
 	} `json:"status"`
 	Metrics struct {
 		ConcurrentConnections int `json:"concurrent_connections"`
 		Process               struct {
-			UptimeInMillis int64 `json:"uptime_in_millis"`
+			UptimeInMillis int64   `json:"uptime_in_millis"`
+			EventLoopDelay float64 `json:"event_loop_delay"`
 			Memory         struct {
 				Heap struct {
 					TotalInBytes int64 `json:"total_in_bytes"`
@@ -85,54 +521,88 @@ type KibanaMetrics struct {
 				Load5m  float64 `json:"5m"`
 				Load15m float64 `json:"15m"`
 			} `json:"load"`
+			CgroupMemory struct {
+				CurrentInBytes int64 `json:"current_in_bytes"`
+			} `json:"cgroup_memory"`
 		} `json:"os"`
 		ResponseTimes struct {
 			AvgInMillis float64 `json:"avg_in_millis"`
 			MaxInMillis float64 `json:"max_in_millis"`
 		} `json:"response_times"`
 		Requests struct {
-			Disconnects int `json:"disconnects"`
-			Total       int `json:"total"`
+			Disconnects int            `json:"disconnects"`
+			Total       int            `json:"total"`
+			StatusCodes map[string]int `json:"status_codes"`
 		} `json:"requests"`
 	} `json:"metrics"`
 }
 
+// kibanaMajorVersion extracts the major version number from a Kibana
+// "x.y.z" version string, e.g. "8.12.1" -> 8. It returns 0 for an
+// empty or unparseable version, which is treated like 6.x/7.x since
+// that was the only metric shape before Kibana started reporting a
+// version number here.
+func kibanaMajorVersion(version string) int {
+	if version == "" {
+		return 0
+	}
+
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return 0
+	}
+
+	return major
+}
+
 // scrape will connect to the Kibana instance, using the details
 // provided by the KibanaCollector struct, and return the metrics as a
 // KibanaMetrics representation.
 func (c *KibanaCollector) scrape() (error, *KibanaMetrics) {
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/status?extended", c.url), nil)
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/api/status?extended", c.url), nil)
 	if err != nil {
-		return errors.New(fmt.Sprintf("could not initialize a request to scrape metrics: %s", err)), nil
+		return &scrapeError{"request", errors.New(fmt.Sprintf("could not initialize a request to scrape metrics: %s", err))}, nil
 	}
 
-	if c.authHeader != "" {
-		req.Header.Add("Authorization", c.authHeader)
+	authHeader := c.authHeader
+	if c.bearerTokenFile != "" {
+		token, err := ioutil.ReadFile(c.bearerTokenFile)
+		if err != nil {
+			return &scrapeError{"request", errors.New(fmt.Sprintf("could not read bearer token file: %s", err))}, nil
+		}
+		authHeader = fmt.Sprintf("Bearer %s", strings.TrimSpace(string(token)))
+	}
+
+	if authHeader != "" {
+		req.Header.Add("Authorization", authHeader)
 	}
 
 	req.Header.Add("Accept", "application/json")
 
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return errors.New(fmt.Sprintf("error while reading Kibana status: %s", err)), nil
+		return &scrapeError{"request", errors.New(fmt.Sprintf("error while reading Kibana status: %s", err))}, nil
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.New(fmt.Sprintf("invalid response from Kibana status: %s", resp.Status)), nil
+		return &scrapeError{"http_status", errors.New(fmt.Sprintf("invalid response from Kibana status: %s", resp.Status))}, nil
 
 	}
 
 	respContent, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return errors.New(fmt.Sprintf("error while reading response from Kibana status: %s", err)), nil
+		return &scrapeError{"decode", errors.New(fmt.Sprintf("error while reading response from Kibana status: %s", err))}, nil
 	}
 
 	metrics := &KibanaMetrics{}
 	err = json.Unmarshal(respContent, &metrics)
 	if err != nil {
-		return errors.New(fmt.Sprintf("error while unmarshalling Kibana status: %s\nProblematic content:\n%s", err, respContent)), nil
+		return &scrapeError{"decode", errors.New(fmt.Sprintf("error while unmarshalling Kibana status: %s\nProblematic content:\n%s", err, respContent))}, nil
 	}
 
 	return nil, metrics
@@ -140,208 +610,386 @@ func (c *KibanaCollector) scrape() (error, *KibanaMetrics) {
 
 // NewExporter will create a Exporter struct and initialize the metrics
 // that will be scraped by Prometheus. It will use the provided Kibana
-// details to populate a KibanaCollector struct.
-func NewExporter(kUrl, kUname, kPwd, namespace string) *Exporter {
-	collector := &KibanaCollector{}
-	collector.url = kUrl
-	collector.client = &http.Client{}
+// details and transport to populate a KibanaCollector struct.
+// constLabels is attached to every metric the Exporter produces, e.g.
+// an "instance" (and optionally "cluster") label when the Exporter is
+// built for a single /probe request rather than the static
+// -kibana.uri target.
+func NewExporter(kUrl string, auth AuthConfig, namespace string, constLabels prometheus.Labels, transport *http.Transport) (*Exporter, error) {
+	collector, err := newKibanaCollector(kUrl, auth, transport)
+	if err != nil {
+		return nil, err
+	}
 
-	if kUname != "" && kPwd != "" {
-		log.Printf("using authenticated requests with Kibana")
-		creds := fmt.Sprintf("%s:%s", *kibanaUsername, *kibanaPassword)
-		encCreds := base64.StdEncoding.EncodeToString([]byte(creds))
-		collector.authHeader = fmt.Sprintf("Basic %s", encCreds)
-	} else {
-		log.Print("Kibana username or password is not provided, assuming unauthenticated communication")
+	desc := func(name, help string, variableLabels []string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, variableLabels, constLabels)
 	}
 
 	exporter := &Exporter{
 		collector: collector,
 
-		status: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "status",
-				Help:      "Kibana overall status",
-				Namespace: namespace,
-			}),
-		concurrentConnections: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "concurrent_connections",
-				Namespace: namespace,
-				Help:      "Kibana Concurrent Connections",
-			}),
-		uptime: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "millis_uptime",
-				Namespace: namespace,
-				Help:      "Kibana uptime in milliseconds",
-			}),
-		heapTotal: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "heap_max_in_bytes",
-				Namespace: namespace,
-				Help:      "Kibana Heap maximum in bytes",
-			}),
-		heapUsed: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "heap_used_in_bytes",
-				Namespace: namespace,
-				Help:      "Kibana Heap usage in bytes",
-			}),
-		load1m: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "os_load_1m",
-				Namespace: namespace,
-				Help:      "Kibana load average 1m",
-			}),
-		load5m: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "os_load_5m",
-				Namespace: namespace,
-				Help:      "Kibana load average 5m",
-			}),
-		load15m: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "os_load_15m",
-				Namespace: namespace,
-				Help:      "Kibana load average 15m",
-			}),
-		respTimeAvg: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "response_average",
-				Namespace: namespace,
-				Help:      "Kibana average response time in milliseconds",
-			}),
-		respTimeMax: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "response_max",
-				Namespace: namespace,
-				Help:      "Kibana maximum response time in milliseconds",
-			}),
-		reqDisconnects: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "requests_disconnects",
-				Namespace: namespace,
-				Help:      "Kibana request disconnections count",
-			}),
-		reqTotal: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "requests_total",
-				Namespace: namespace,
-				Help:      "Kibana total request count",
-			}),
-	}
-
-	return exporter
-}
-
-// parseMetrics will set the metrics values using the KibanaMetrics
-// struct, converting values to float64 where needed.
-func (e *Exporter) parseMetrics(m *KibanaMetrics) error {
+		scrapeErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        "scrape_errors_total",
+				Namespace:   namespace,
+				Help:        "Total number of scrape errors, by kind",
+				ConstLabels: constLabels,
+			}, []string{"kind"}),
+
+		upDesc:             desc("up", "Whether the last scrape of the Kibana target succeeded", nil),
+		scrapeDurationDesc: desc("scrape_duration_seconds", "How long the last scrape of the Kibana target took in seconds", nil),
+		versionInfoDesc:    desc("version_info", "Kibana version, always 1", []string{"version"}),
+
+		statusDesc:                desc("status", "Kibana overall status", nil),
+		concurrentConnectionsDesc: desc("concurrent_connections", "Kibana Concurrent Connections", nil),
+		uptimeDesc:                desc("millis_uptime", "Kibana uptime in milliseconds", nil),
+		heapTotalDesc:             desc("heap_max_in_bytes", "Kibana Heap maximum in bytes", nil),
+		heapUsedDesc:              desc("heap_used_in_bytes", "Kibana Heap usage in bytes", nil),
+		load1mDesc:                desc("os_load_1m", "Kibana load average 1m", nil),
+		load5mDesc:                desc("os_load_5m", "Kibana load average 5m", nil),
+		load15mDesc:               desc("os_load_15m", "Kibana load average 15m", nil),
+		respTimeAvgDesc:           desc("response_average", "Kibana average response time in milliseconds", nil),
+		respTimeMaxDesc:           desc("response_max", "Kibana maximum response time in milliseconds", nil),
+		reqDisconnectsDesc:        desc("requests_disconnects", "Kibana request disconnections count", nil),
+		reqTotalDesc:              desc("requests_total", "Kibana total request count", nil),
+		pluginStatusDesc:          desc("plugin_status", "Kibana per-plugin/core-service status, 1 for the current state and 0 for the others", []string{"plugin", "state"}),
+
+		cgroupMemoryDesc:   desc("os_cgroup_memory_current_bytes", "Kibana host cgroup current memory usage in bytes (Kibana 8.x+)", nil),
+		eventLoopDelayDesc: desc("process_event_loop_delay_seconds", "Kibana Node.js event loop delay in seconds (Kibana 8.x+)", nil),
+		reqStatusCodesDesc: desc("requests_status_codes_total", "Kibana request count by HTTP status code (Kibana 8.x+)", []string{"code"}),
+	}
+
+	return exporter, nil
+}
+
+// Describe is the Exporter implementing prometheus.Collector
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.upDesc
+	ch <- e.scrapeDurationDesc
+	e.scrapeErrors.Describe(ch)
+	ch <- e.versionInfoDesc
+
+	ch <- e.statusDesc
+	ch <- e.concurrentConnectionsDesc
+	ch <- e.uptimeDesc
+	ch <- e.heapTotalDesc
+	ch <- e.heapUsedDesc
+	ch <- e.load1mDesc
+	ch <- e.load5mDesc
+	ch <- e.load15mDesc
+	ch <- e.respTimeAvgDesc
+	ch <- e.respTimeMaxDesc
+	ch <- e.reqDisconnectsDesc
+	ch <- e.reqTotalDesc
+	ch <- e.pluginStatusDesc
+
+	ch <- e.cgroupMemoryDesc
+	ch <- e.eventLoopDelayDesc
+	ch <- e.reqStatusCodesDesc
+}
+
+// sendCore emits the metrics common to every supported Kibana
+// version from a successful scrape.
+func (e *Exporter) sendCore(ch chan<- prometheus.Metric, m *KibanaMetrics) {
 	// any value other than "green" is assumed to be less than 1
 	statusVal := 0.0
 	if strings.ToLower(m.Status.Overall.State) == "green" {
 		statusVal = 1.0
 	}
 
-	e.status.Set(statusVal)
-
-	e.concurrentConnections.Set(float64(m.Metrics.ConcurrentConnections))
-	e.uptime.Set(float64(m.Metrics.Process.UptimeInMillis))
-	e.heapTotal.Set(float64(m.Metrics.Process.Memory.Heap.TotalInBytes))
-	e.heapUsed.Set(float64(m.Metrics.Process.Memory.Heap.UsedInBytes))
-	e.load1m.Set(m.Metrics.Os.Load.Load1m)
-	e.load5m.Set(m.Metrics.Os.Load.Load5m)
-	e.load15m.Set(m.Metrics.Os.Load.Load15m)
-	e.respTimeAvg.Set(m.Metrics.ResponseTimes.AvgInMillis)
-	e.respTimeMax.Set(m.Metrics.ResponseTimes.MaxInMillis)
-	e.reqDisconnects.Set(float64(m.Metrics.Requests.Disconnects))
-	e.reqTotal.Set(float64(m.Metrics.Requests.Total))
-
-	return nil
+	ch <- prometheus.MustNewConstMetric(e.statusDesc, prometheus.GaugeValue, statusVal)
+	ch <- prometheus.MustNewConstMetric(e.concurrentConnectionsDesc, prometheus.GaugeValue, float64(m.Metrics.ConcurrentConnections))
+	ch <- prometheus.MustNewConstMetric(e.uptimeDesc, prometheus.GaugeValue, float64(m.Metrics.Process.UptimeInMillis))
+	ch <- prometheus.MustNewConstMetric(e.heapTotalDesc, prometheus.GaugeValue, float64(m.Metrics.Process.Memory.Heap.TotalInBytes))
+	ch <- prometheus.MustNewConstMetric(e.heapUsedDesc, prometheus.GaugeValue, float64(m.Metrics.Process.Memory.Heap.UsedInBytes))
+	ch <- prometheus.MustNewConstMetric(e.load1mDesc, prometheus.GaugeValue, m.Metrics.Os.Load.Load1m)
+	ch <- prometheus.MustNewConstMetric(e.load5mDesc, prometheus.GaugeValue, m.Metrics.Os.Load.Load5m)
+	ch <- prometheus.MustNewConstMetric(e.load15mDesc, prometheus.GaugeValue, m.Metrics.Os.Load.Load15m)
+	ch <- prometheus.MustNewConstMetric(e.respTimeAvgDesc, prometheus.GaugeValue, m.Metrics.ResponseTimes.AvgInMillis)
+	ch <- prometheus.MustNewConstMetric(e.respTimeMaxDesc, prometheus.GaugeValue, m.Metrics.ResponseTimes.MaxInMillis)
+	ch <- prometheus.MustNewConstMetric(e.reqDisconnectsDesc, prometheus.GaugeValue, float64(m.Metrics.Requests.Disconnects))
+	ch <- prometheus.MustNewConstMetric(e.reqTotalDesc, prometheus.GaugeValue, float64(m.Metrics.Requests.Total))
+
+	for _, s := range m.Status.Statuses {
+		current := strings.ToLower(s.State)
+		for _, state := range kibanaStatusStates {
+			val := 0.0
+			if state == current {
+				val = 1.0
+			}
+			ch <- prometheus.MustNewConstMetric(e.pluginStatusDesc, prometheus.GaugeValue, val, s.ID, state)
+		}
+	}
 }
 
-func (e *Exporter) send(ch chan<- prometheus.Metric) error {
-	ch <- e.status
-	ch <- e.concurrentConnections
-	ch <- e.uptime
-	ch <- e.heapTotal
-	ch <- e.heapUsed
-	ch <- e.load1m
-	ch <- e.load5m
-	ch <- e.load15m
-	ch <- e.respTimeAvg
-	ch <- e.respTimeMax
-	ch <- e.reqDisconnects
-	ch <- e.reqTotal
-
-	return nil
+// sendZeroed emits a 0 value for every fixed core gauge, used when a
+// scrape fails so that kibana_up == 0 is not served alongside stale
+// values from a previous successful scrape. No kibana_plugin_status
+// series are emitted, since the plugin list comes from the scrape.
+func (e *Exporter) sendZeroed(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(e.statusDesc, prometheus.GaugeValue, 0)
+	ch <- prometheus.MustNewConstMetric(e.concurrentConnectionsDesc, prometheus.GaugeValue, 0)
+	ch <- prometheus.MustNewConstMetric(e.uptimeDesc, prometheus.GaugeValue, 0)
+	ch <- prometheus.MustNewConstMetric(e.heapTotalDesc, prometheus.GaugeValue, 0)
+	ch <- prometheus.MustNewConstMetric(e.heapUsedDesc, prometheus.GaugeValue, 0)
+	ch <- prometheus.MustNewConstMetric(e.load1mDesc, prometheus.GaugeValue, 0)
+	ch <- prometheus.MustNewConstMetric(e.load5mDesc, prometheus.GaugeValue, 0)
+	ch <- prometheus.MustNewConstMetric(e.load15mDesc, prometheus.GaugeValue, 0)
+	ch <- prometheus.MustNewConstMetric(e.respTimeAvgDesc, prometheus.GaugeValue, 0)
+	ch <- prometheus.MustNewConstMetric(e.respTimeMaxDesc, prometheus.GaugeValue, 0)
+	ch <- prometheus.MustNewConstMetric(e.reqDisconnectsDesc, prometheus.GaugeValue, 0)
+	ch <- prometheus.MustNewConstMetric(e.reqTotalDesc, prometheus.GaugeValue, 0)
 }
 
-// Describe is the Exporter implementing prometheus.Collector
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- e.status.Desc()
-	ch <- e.concurrentConnections.Desc()
-	ch <- e.uptime.Desc()
-	ch <- e.heapTotal.Desc()
-	ch <- e.heapUsed.Desc()
-	ch <- e.load1m.Desc()
-	ch <- e.load5m.Desc()
-	ch <- e.load15m.Desc()
-	ch <- e.respTimeAvg.Desc()
-	ch <- e.respTimeMax.Desc()
-	ch <- e.reqDisconnects.Desc()
-	ch <- e.reqTotal.Desc()
+// sendV8 emits the metrics only available on Kibana 8.x, where
+// /api/status grew an event loop delay gauge, a cgroup-aware memory
+// reading, and a breakdown of response status codes.
+func (e *Exporter) sendV8(ch chan<- prometheus.Metric, m *KibanaMetrics) {
+	ch <- prometheus.MustNewConstMetric(e.cgroupMemoryDesc, prometheus.GaugeValue, float64(m.Metrics.Os.CgroupMemory.CurrentInBytes))
+	ch <- prometheus.MustNewConstMetric(e.eventLoopDelayDesc, prometheus.GaugeValue, m.Metrics.Process.EventLoopDelay)
+
+	for code, count := range m.Metrics.Requests.StatusCodes {
+		ch <- prometheus.MustNewConstMetric(e.reqStatusCodesDesc, prometheus.GaugeValue, float64(count), code)
+	}
 }
 
 // Collect is the Exporter implementing prometheus.Collector
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	e.lock.Lock()
-	defer e.lock.Unlock()
-
+	start := time.Now()
 	err, metrics := e.collector.scrape()
+	ch <- prometheus.MustNewConstMetric(e.scrapeDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds())
+
 	if err != nil {
 		log.Printf("error while scraping metrics from Kibana: %s", err)
+		ch <- prometheus.MustNewConstMetric(e.upDesc, prometheus.GaugeValue, 0)
+		e.sendZeroed(ch)
+		e.scrapeErrors.WithLabelValues(errorKind(err)).Inc()
+		e.scrapeErrors.Collect(ch)
+		return
+	}
+
+	e.scrapeErrors.Collect(ch)
+	ch <- prometheus.MustNewConstMetric(e.upDesc, prometheus.GaugeValue, 1)
+
+	if metrics.Version.Number != "" {
+		ch <- prometheus.MustNewConstMetric(e.versionInfoDesc, prometheus.GaugeValue, 1, metrics.Version.Number)
+	}
+
+	e.sendCore(ch, metrics)
+
+	if kibanaMajorVersion(metrics.Version.Number) >= 8 {
+		e.sendV8(ch, metrics)
+	}
+}
+
+// metricDoc is one row of the landing page's metric catalogue.
+type metricDoc struct {
+	Name string
+	Help string
+	Type string
+}
+
+// metricCatalog is the single source of truth for every metric the
+// Exporter can produce: it drives the landing page's metric table
+// directly, rather than introspecting *prometheus.Desc, whose
+// String() debug format is not part of client_golang's API contract
+// and could change out from under a regex without a compile error.
+// Keep this in sync with the desc(...) calls in NewExporter.
+var metricCatalog = []metricDoc{
+	{"kibana_up", "Whether the last scrape of the Kibana target succeeded", "gauge"},
+	{"kibana_scrape_duration_seconds", "How long the last scrape of the Kibana target took in seconds", "gauge"},
+	{"kibana_scrape_errors_total", "Total number of scrape errors, by kind", "counter"},
+	{"kibana_version_info", "Kibana version, always 1", "gauge"},
+	{"kibana_status", "Kibana overall status", "gauge"},
+	{"kibana_concurrent_connections", "Kibana Concurrent Connections", "gauge"},
+	{"kibana_millis_uptime", "Kibana uptime in milliseconds", "gauge"},
+	{"kibana_heap_max_in_bytes", "Kibana Heap maximum in bytes", "gauge"},
+	{"kibana_heap_used_in_bytes", "Kibana Heap usage in bytes", "gauge"},
+	{"kibana_os_load_1m", "Kibana load average 1m", "gauge"},
+	{"kibana_os_load_5m", "Kibana load average 5m", "gauge"},
+	{"kibana_os_load_15m", "Kibana load average 15m", "gauge"},
+	{"kibana_response_average", "Kibana average response time in milliseconds", "gauge"},
+	{"kibana_response_max", "Kibana maximum response time in milliseconds", "gauge"},
+	{"kibana_requests_disconnects", "Kibana request disconnections count", "gauge"},
+	{"kibana_requests_total", "Kibana total request count", "gauge"},
+	{"kibana_plugin_status", "Kibana per-plugin/core-service status, 1 for the current state and 0 for the others", "gauge"},
+	{"kibana_os_cgroup_memory_current_bytes", "Kibana host cgroup current memory usage in bytes (Kibana 8.x+)", "gauge"},
+	{"kibana_process_event_loop_delay_seconds", "Kibana Node.js event loop delay in seconds (Kibana 8.x+)", "gauge"},
+	{"kibana_requests_status_codes_total", "Kibana request count by HTTP status code (Kibana 8.x+)", "gauge"},
+}
+
+// landingPageTemplate renders the "/" landing page, listing every
+// metric the exporter can produce alongside its help text and type
+// so the page doubles as documentation.
+var landingPageTemplate = template.Must(template.New("landing").Parse(`<html>
+<head><title>Kibana Exporter</title></head>
+<body>
+<h1>Kibana Exporter</h1>
+<p><a href='{{.MetricsPath}}'>Metrics</a></p>
+<p><a href='{{.ProbePath}}?target=https://kibana.example'>Probe a target</a></p>
+<h2>Metrics</h2>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Name</th><th>Type</th><th>Help</th></tr>
+{{range .Metrics}}<tr><td>{{.Name}}</td><td>{{.Type}}</td><td>{{.Help}}</td></tr>
+{{end}}</table>
+</body>
+</html>`))
+
+// landingPageHandler renders landingPageTemplate against the static
+// metricCatalog.
+func landingPageHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		MetricsPath string
+		ProbePath   string
+		Metrics     []metricDoc
+	}{
+		MetricsPath: *metricsPath,
+		ProbePath:   *probePath,
+		Metrics:     metricCatalog,
+	}
+
+	if err := landingPageTemplate.Execute(w, data); err != nil {
+		log.Printf("error rendering landing page: %s", err)
+	}
+}
+
+// probeHandler services /probe?target=...&module=... requests. It
+// builds a fresh Exporter for the requested target and registers it
+// against a dedicated registry, so concurrent probes never share
+// state, in the style of the blackbox_exporter /probe endpoint.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
 		return
 	}
 
-	err = e.parseMetrics(metrics)
+	module := r.URL.Query().Get("module")
+	if module == "" {
+		module = "default"
+	}
+
+	var modCfg ModuleConfig
+	var cluster string
+
+	if *configFile != "" {
+		cfg, err := loadProbeConfig(*configFile)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error loading config file: %s", err), http.StatusInternalServerError)
+			return
+		}
+
+		if m, ok := cfg.Modules[module]; ok {
+			modCfg = m
+		} else if module != "default" {
+			http.Error(w, fmt.Sprintf("unknown module %q", module), http.StatusBadRequest)
+			return
+		}
+
+		if t, ok := cfg.Targets[target]; ok {
+			cluster = t.Cluster
+		}
+	}
+
+	constLabels := prometheus.Labels{"instance": target}
+	if cluster != "" {
+		constLabels["cluster"] = cluster
+	}
+
+	auth := modCfg.AuthConfig()
+	transport, err := cachedProbeTransport(probeTransportKey(module, target, auth), auth)
 	if err != nil {
-		log.Printf("error while parsing metrics from Kibana: %s", err)
+		http.Error(w, fmt.Sprintf("error building transport for target %q: %s", target, err), http.StatusInternalServerError)
 		return
 	}
 
-	err = e.send(ch)
+	registry := prometheus.NewRegistry()
+	exporter, err := NewExporter(target, auth, namespace, constLabels, transport)
 	if err != nil {
-		log.Printf("error while responding to Prometheus with metrics: %s", err)
+		http.Error(w, fmt.Sprintf("error building collector for target %q: %s", target, err), http.StatusInternalServerError)
+		return
 	}
+	registry.MustRegister(exporter)
+
+	// Scraping the target happens inside exporter.Collect, invoked by
+	// HandlerFor below; kibana_up and kibana_scrape_duration_seconds
+	// on the instance/cluster labels already report success/latency,
+	// so there is no separate probe_success/probe_duration_seconds
+	// pair to maintain here.
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
 }
 
 func main() {
 	flag.Parse()
 
-	if *kibanaUri == "" {
-		log.Fatal("required flag -kibana.uri not provided, aborting")
+	if *kibanaUri != "" {
+		log.Printf("using Kibana URL: %s", *kibanaUri)
+
+		auth := AuthConfig{
+			Username:           *kibanaUsername,
+			Password:           *kibanaPassword,
+			BearerToken:        *kibanaBearerToken,
+			BearerTokenFile:    *kibanaBearerTokenFile,
+			APIKey:             *kibanaApiKey,
+			CAFile:             *kibanaCaFile,
+			CertFile:           *kibanaCertFile,
+			KeyFile:            *kibanaKeyFile,
+			InsecureSkipVerify: *kibanaInsecureSkip,
+			Timeout:            *kibanaTimeout,
+		}
+
+		transport, err := buildTransport(auth)
+		if err != nil {
+			log.Fatalf("error building Kibana transport: %s", err)
+		}
+
+		exporter, err := NewExporter(*kibanaUri, auth, namespace, nil, transport)
+		if err != nil {
+			log.Fatalf("error building Kibana collector: %s", err)
+		}
+		prometheus.MustRegister(exporter)
+	} else if *configFile == "" {
+		log.Fatal("neither -kibana.uri nor -config.file was provided, aborting")
 		os.Exit(1)
 	}
 
-	log.Printf("using Kibana URL: %s", *kibanaUri)
+	var webConfig *WebConfig
+	if *webConfigFile != "" {
+		cfg, err := loadWebConfig(*webConfigFile)
+		if err != nil {
+			log.Fatalf("error loading web config file: %s", err)
+		}
+		webConfig = cfg
+	}
 
-	exporter := NewExporter(*kibanaUri, *kibanaUsername, *kibanaPassword, namespace)
-	prometheus.MustRegister(exporter)
+	var metricsHandler http.Handler = promhttp.Handler()
+	var probeHandlerFunc http.Handler = http.HandlerFunc(probeHandler)
+	if webConfig != nil && len(webConfig.BasicAuthUsers) > 0 {
+		metricsHandler = basicAuthMiddleware(metricsHandler, webConfig.BasicAuthUsers)
+		// /probe fetches arbitrary operator-supplied targets using the
+		// credentials in -config.file, so it needs the same protection
+		// as /metrics once basic auth is configured.
+		probeHandlerFunc = basicAuthMiddleware(probeHandlerFunc, webConfig.BasicAuthUsers)
+	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-             <head><title>Kibana Exporter</title></head>
-             <body>
-             <h1>Kibana Exporter</h1>
-             <p><a href='` + *metricsPath + `'>Metrics</a></p>
-             </body>
-             </html>`))
-	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", landingPageHandler)
+	mux.Handle(*metricsPath, metricsHandler)
+	mux.Handle(*probePath, probeHandlerFunc)
 
-	http.Handle(*metricsPath, promhttp.Handler())
+	server := &http.Server{Addr: *addr, Handler: mux}
+
+	if webConfig == nil || webConfig.TLSConfig.CertFile == "" {
+		log.Printf("starting metrics server at %s", *addr)
+		log.Fatal(server.ListenAndServe())
+	}
+
+	tlsConfig, err := buildServerTLSConfig(webConfig.TLSConfig)
+	if err != nil {
+		log.Fatalf("error building server TLS config: %s", err)
+	}
+	server.TLSConfig = tlsConfig
 
-	log.Printf("starting metrics server at %s", *addr)
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	log.Printf("starting metrics server with TLS at %s", *addr)
+	log.Fatal(server.ListenAndServeTLS(webConfig.TLSConfig.CertFile, webConfig.TLSConfig.KeyFile))
 }
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestNewKibanaCollectorAuthPrecedence verifies that when more than one
+// auth method is configured, newKibanaCollector honors the precedence
+// documented on AuthConfig: BearerToken > BearerTokenFile > APIKey >
+// Username/Password.
+func TestNewKibanaCollectorAuthPrecedence(t *testing.T) {
+	cfg := AuthConfig{
+		BearerToken:     "static-token",
+		BearerTokenFile: "/path/to/token",
+		APIKey:          "api-key",
+		Username:        "user",
+		Password:        "pass",
+	}
+
+	collector, err := newKibanaCollector("http://kibana.example", cfg, nil)
+	if err != nil {
+		t.Fatalf("newKibanaCollector() error = %v", err)
+	}
+
+	if collector.authHeader != "Bearer static-token" {
+		t.Errorf("authHeader = %q, want %q", collector.authHeader, "Bearer static-token")
+	}
+
+	if collector.bearerTokenFile != "" {
+		t.Errorf("bearerTokenFile = %q, want empty: a static BearerToken must win over BearerTokenFile", collector.bearerTokenFile)
+	}
+}
+
+// TestNewKibanaCollectorBearerTokenFileFallback verifies that
+// BearerTokenFile is only honored when no static BearerToken is set.
+func TestNewKibanaCollectorBearerTokenFileFallback(t *testing.T) {
+	cfg := AuthConfig{
+		BearerTokenFile: "/path/to/token",
+		APIKey:          "api-key",
+	}
+
+	collector, err := newKibanaCollector("http://kibana.example", cfg, nil)
+	if err != nil {
+		t.Fatalf("newKibanaCollector() error = %v", err)
+	}
+
+	if collector.bearerTokenFile != "/path/to/token" {
+		t.Errorf("bearerTokenFile = %q, want %q", collector.bearerTokenFile, "/path/to/token")
+	}
+
+	if collector.authHeader != "" {
+		t.Errorf("authHeader = %q, want empty: scrape() reads the token file itself", collector.authHeader)
+	}
+}
+
+// TestCachedProbeTransportReusesSameKey verifies that
+// cachedProbeTransport returns the same *http.Transport for repeated
+// calls with the same key, so probes of a stable target set reuse
+// connections, and a distinct one for a different key.
+func TestCachedProbeTransportReusesSameKey(t *testing.T) {
+	first, err := cachedProbeTransport("default|https://kibana.example", AuthConfig{})
+	if err != nil {
+		t.Fatalf("cachedProbeTransport() error = %v", err)
+	}
+
+	second, err := cachedProbeTransport("default|https://kibana.example", AuthConfig{})
+	if err != nil {
+		t.Fatalf("cachedProbeTransport() error = %v", err)
+	}
+
+	if first != second {
+		t.Error("cachedProbeTransport() returned a different *http.Transport for the same key")
+	}
+
+	other, err := cachedProbeTransport("default|https://other.example", AuthConfig{})
+	if err != nil {
+		t.Fatalf("cachedProbeTransport() error = %v", err)
+	}
+
+	if first == other {
+		t.Error("cachedProbeTransport() returned the same *http.Transport for a different key")
+	}
+}
+
+// TestProbeTransportKeyChangesWithTLSConfig verifies that
+// probeTransportKey produces a different key when the TLS-relevant
+// fields of AuthConfig change for the same module/target, so editing
+// -config.file invalidates the cached transport for a target that is
+// still being actively probed, instead of only evicting on idle.
+func TestProbeTransportKeyChangesWithTLSConfig(t *testing.T) {
+	base := probeTransportKey("default", "https://kibana.example", AuthConfig{})
+
+	tests := []struct {
+		name string
+		cfg  AuthConfig
+	}{
+		{"ca file", AuthConfig{CAFile: "/etc/ssl/ca.pem"}},
+		{"cert file", AuthConfig{CertFile: "/etc/ssl/client.pem"}},
+		{"key file", AuthConfig{KeyFile: "/etc/ssl/client-key.pem"}},
+		{"insecure skip verify", AuthConfig{InsecureSkipVerify: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := probeTransportKey("default", "https://kibana.example", tt.cfg)
+			if key == base {
+				t.Errorf("probeTransportKey() = %q, want different from the zero-value AuthConfig key %q", key, base)
+			}
+		})
+	}
+}
+
+// TestCachedProbeTransportInvalidatesOnKeyChange verifies that
+// cachedProbeTransport, fed the key produced by probeTransportKey,
+// builds a fresh *http.Transport once the underlying AuthConfig (and
+// therefore the key) changes for what is otherwise the same
+// module/target, rather than keeping the transport built from the
+// first probe forever.
+func TestCachedProbeTransportInvalidatesOnKeyChange(t *testing.T) {
+	insecureCfg := AuthConfig{InsecureSkipVerify: true}
+	first, err := cachedProbeTransport(probeTransportKey("default", "https://kibana.example", insecureCfg), insecureCfg)
+	if err != nil {
+		t.Fatalf("cachedProbeTransport() error = %v", err)
+	}
+	if !first.TLSClientConfig.InsecureSkipVerify {
+		t.Fatalf("first transport InsecureSkipVerify = false, want true")
+	}
+
+	verifiedCfg := AuthConfig{InsecureSkipVerify: false}
+	second, err := cachedProbeTransport(probeTransportKey("default", "https://kibana.example", verifiedCfg), verifiedCfg)
+	if err != nil {
+		t.Fatalf("cachedProbeTransport() error = %v", err)
+	}
+
+	if second == first {
+		t.Error("cachedProbeTransport() reused the transport built with InsecureSkipVerify=true after the config changed")
+	}
+	if second.TLSClientConfig.InsecureSkipVerify {
+		t.Error("second transport InsecureSkipVerify = true, want false")
+	}
+}
+
+// TestBasicAuthMiddleware verifies that basicAuthMiddleware lets a
+// request through only when it carries a known username and its
+// matching password, and rejects everything else (unknown username,
+// wrong password, missing credentials) with 401, guarding against a
+// regression of the timing short-circuit fixed for username
+// enumeration.
+func TestBasicAuthMiddleware(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword() error = %v", err)
+	}
+
+	users := map[string]string{"alice": string(hash)}
+
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		noCreds    bool
+		wantStatus int
+		wantCalled bool
+	}{
+		{
+			name:       "unknown username",
+			username:   "mallory",
+			password:   "whatever",
+			wantStatus: http.StatusUnauthorized,
+			wantCalled: false,
+		},
+		{
+			name:       "known username wrong password",
+			username:   "alice",
+			password:   "wrong-password",
+			wantStatus: http.StatusUnauthorized,
+			wantCalled: false,
+		},
+		{
+			name:       "known username correct password",
+			username:   "alice",
+			password:   "correct-password",
+			wantStatus: http.StatusOK,
+			wantCalled: true,
+		},
+		{
+			name:       "missing credentials",
+			noCreds:    true,
+			wantStatus: http.StatusUnauthorized,
+			wantCalled: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called = false
+
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if !tt.noCreds {
+				req.SetBasicAuth(tt.username, tt.password)
+			}
+			rr := httptest.NewRecorder()
+
+			basicAuthMiddleware(next, users).ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if called != tt.wantCalled {
+				t.Errorf("next called = %v, want %v", called, tt.wantCalled)
+			}
+		})
+	}
+}
+
+// descFqNameRe extracts the fqName field out of a *prometheus.Desc's
+// debug String(), which is the only way to get it back out: Desc
+// keeps fqName unexported and exposes no accessor.
+var descFqNameRe = regexp.MustCompile(`fqName: "([^"]+)"`)
+
+// TestMetricCatalogMatchesDescribe verifies that metricCatalog, the
+// landing page's metric catalogue, lists exactly the metric names
+// Exporter.Describe emits: no more, no less. This keeps the two from
+// silently drifting apart the way the regex-over-Desc approach it
+// replaced could.
+func TestMetricCatalogMatchesDescribe(t *testing.T) {
+	exporter, err := NewExporter("http://kibana.example", AuthConfig{}, namespace, nil, nil)
+	if err != nil {
+		t.Fatalf("NewExporter() error = %v", err)
+	}
+
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		exporter.Describe(ch)
+		close(ch)
+	}()
+
+	described := make(map[string]bool)
+	for d := range ch {
+		m := descFqNameRe.FindStringSubmatch(d.String())
+		if m == nil {
+			t.Fatalf("could not extract fqName from %s", d.String())
+		}
+		described[m[1]] = true
+	}
+
+	cataloged := make(map[string]bool, len(metricCatalog))
+	for _, doc := range metricCatalog {
+		cataloged[doc.Name] = true
+	}
+
+	var missingFromCatalog, missingFromDescribe []string
+	for name := range described {
+		if !cataloged[name] {
+			missingFromCatalog = append(missingFromCatalog, name)
+		}
+	}
+	for name := range cataloged {
+		if !described[name] {
+			missingFromDescribe = append(missingFromDescribe, name)
+		}
+	}
+	sort.Strings(missingFromCatalog)
+	sort.Strings(missingFromDescribe)
+
+	if len(missingFromCatalog) > 0 {
+		t.Errorf("Describe() emits metrics missing from metricCatalog: %v", missingFromCatalog)
+	}
+	if len(missingFromDescribe) > 0 {
+		t.Errorf("metricCatalog lists metrics Describe() never emits: %v", missingFromDescribe)
+	}
+}
+
+// fakeKibanaStatus is a canned /api/status?extended response body.
+// The 8.x-only fields (os.cgroup_memory, process.event_loop_delay,
+// requests.status_codes) are included so a test can assert they are
+// exposed only when version is 8.x or newer.
+const fakeKibanaStatus = `{
+	"version": {"number": %q},
+	"status": {
+		"overall": {"state": "green"},
+		"statuses": [{"id": "plugin:elasticsearch@7.x", "state": "green"}]
+	},
+	"metrics": {
+		"concurrent_connections": 5,
+		"process": {
+			"uptime_in_millis": 1000,
+			"event_loop_delay": 0.002,
+			"memory": {"heap": {"total_in_bytes": 2000, "used_in_bytes": 1000}}
+		},
+		"os": {
+			"load": {"1m": 0.1, "5m": 0.2, "15m": 0.3},
+			"cgroup_memory": {"current_in_bytes": 4096}
+		},
+		"response_times": {"avg_in_millis": 12.5, "max_in_millis": 99.0},
+		"requests": {"disconnects": 1, "total": 42, "status_codes": {"200": 40, "500": 2}}
+	}
+}`
+
+// newFakeKibanaServer starts an httptest.Server that serves
+// fakeKibanaStatus for the given Kibana version on /api/status.
+func newFakeKibanaServer(t *testing.T, version string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, fakeKibanaStatus, version)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// TestExporterCollectVersionGating verifies that Collect only emits
+// the Kibana 8.x-only metrics (cgroup memory, event loop delay,
+// request status codes) when the scraped version is 8.x or newer,
+// leaving them absent on 6.x/7.x rather than zeroed.
+func TestExporterCollectVersionGating(t *testing.T) {
+	tests := []struct {
+		name       string
+		version    string
+		wantV8Only bool
+	}{
+		{"7.x", "7.17.0", false},
+		{"8.x", "8.12.1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeKibanaServer(t, tt.version)
+
+			exporter, err := NewExporter(server.URL, AuthConfig{Timeout: 5 * time.Second}, namespace, nil, &http.Transport{})
+			if err != nil {
+				t.Fatalf("NewExporter() error = %v", err)
+			}
+
+			for _, metric := range []string{
+				"kibana_os_cgroup_memory_current_bytes",
+				"kibana_process_event_loop_delay_seconds",
+				"kibana_requests_status_codes_total",
+			} {
+				count := testutil.CollectAndCount(exporter, metric)
+				wantCount := 0
+				if tt.wantV8Only {
+					wantCount = 1
+					if metric == "kibana_requests_status_codes_total" {
+						wantCount = 2 // one series per status code in the fake response
+					}
+				}
+				if count != wantCount {
+					t.Errorf("CollectAndCount(%s) = %d, want %d", metric, count, wantCount)
+				}
+			}
+
+			if got := testutil.CollectAndCount(exporter, "kibana_up"); got != 1 {
+				t.Errorf("CollectAndCount(kibana_up) = %d, want 1", got)
+			}
+		})
+	}
+}
+
+// TestProbeHandlerEndToEnd exercises probeHandler against a fake
+// Kibana server and a -config.file on disk, verifying that the
+// resulting /metrics-style response carries the instance/cluster
+// labels from the module/target config and the plugin status reported
+// by the fake Kibana.
+func TestProbeHandlerEndToEnd(t *testing.T) {
+	server := newFakeKibanaServer(t, "7.17.0")
+
+	configPath := filepath.Join(t.TempDir(), "probe.yml")
+	configBody := fmt.Sprintf(`
+modules:
+  secure:
+    insecure_skip_verify: true
+targets:
+  %q:
+    cluster: test-cluster
+`, server.URL)
+	if err := os.WriteFile(configPath, []byte(configBody), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() error = %v", err)
+	}
+
+	prevConfigFile := *configFile
+	*configFile = configPath
+	t.Cleanup(func() { *configFile = prevConfigFile })
+
+	req := httptest.NewRequest(http.MethodGet, "/probe?"+url.Values{
+		"target": {server.URL},
+		"module": {"secure"},
+	}.Encode(), nil)
+	rr := httptest.NewRecorder()
+
+	probeHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	body := rr.Body.String()
+	wantContains := []string{
+		fmt.Sprintf(`kibana_up{cluster="test-cluster",instance=%q} 1`, server.URL),
+		fmt.Sprintf(`kibana_plugin_status{cluster="test-cluster",instance=%q,plugin="plugin:elasticsearch@7.x",state="green"} 1`, server.URL),
+	}
+	for _, want := range wantContains {
+		if !strings.Contains(body, want) {
+			t.Errorf("response body does not contain %q; body:\n%s", want, body)
+		}
+	}
+}